@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"container/list"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -11,31 +12,102 @@ import (
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hauke96/sigolo"
 )
 
+// defaultHitWindow is used when a cache's config doesn't set HitWindow.
+const defaultHitWindow = 10 * time.Minute
+
+// cacheTmpInfix marks the temp file put writes a new entry's content to
+// before renaming it into place, so a scan mid-write doesn't pick up a
+// partially written file as a real cache entry.
+const cacheTmpInfix = ".tmp-"
+
+// Caches is the registry of named cache partitions. Each partition has its
+// own folder, age limit and size quota, configured via config.Caches and
+// addressed from config.CacheRules by name.
+type Caches map[string]*Cache
+
 type Cache struct {
+	name        string
 	folder      string
+	maxAge      time.Duration
+	maxSize     int64
+	maxItems    int
 	hash        hash.Hash
 	knownValues map[string]KnownValues
 	busyValues  map[string]*sync.Mutex
 	mutex       *sync.Mutex
+
+	// currentSize is the approximate number of bytes this cache currently
+	// holds on disk, maintained by release/tidy so tidyLoop doesn't have to
+	// stat the whole folder on every put. Accessed atomically.
+	currentSize int64
+	// tidySignal wakes tidyLoop as soon as currentSize crosses maxSize,
+	// instead of waiting for the next periodic tidy tick.
+	tidySignal chan struct{}
+
+	// pendingHits counts requests for a not-yet-cached key, keyed by hash, so
+	// that a rule's After threshold can be enforced. Guarded by mutex.
+	pendingHits map[string]hitCount
+
+	// lastAccess records the last time each known entry was actually read,
+	// keyed by hash, so tidy can evict by least-recently-used instead of
+	// least-recently-written. Guarded by mutex. An entry missing from this
+	// map (e.g. just loaded from disk at startup, never read since) falls
+	// back to its file's mtime.
+	lastAccess map[string]time.Time
+	// hitWindow bounds how long a pending hit count is remembered; a key not
+	// seen again within this window starts counting from zero.
+	hitWindow time.Duration
+
+	// openFiles holds already-open file handles for hot reads, see openfiles.go.
+	openFiles       map[string]*openFileEnt
+	openFilesOrder  *list.List
+	openFilesElems  map[string]*list.Element
+	openFilesMutex  sync.Mutex
+	maxOpenFiles    int
+	openFileIdleTTL time.Duration
+}
+
+type hitCount struct {
+	count  int
+	seenAt time.Time
 }
 
 type KnownValues struct {
 	loadedAt time.Time
 	content  []byte
+	size     int64
+}
+
+// CreateCaches builds one Cache per entry of config.Caches, creating each
+// cache's folder on disk if it doesn't already exist.
+func CreateCaches(cfg *Config) (Caches, error) {
+	caches := make(Caches, len(cfg.Caches))
+
+	for name, cacheCfg := range cfg.Caches {
+		cache, err := createCache(name, cacheCfg)
+		if err != nil {
+			return nil, err
+		}
+		caches[name] = cache
+	}
+
+	return caches, nil
 }
 
-func CreateCache(path string) (*Cache, error) {
-	fileInfos, err := ioutil.ReadDir(path)
+func createCache(name string, cfg CacheConfig) (*Cache, error) {
+	fileInfos, err := ioutil.ReadDir(cfg.Dir)
 	if err != nil {
-		sigolo.Error("Cannot open cache folder '%s': %s", path, err)
-		sigolo.Info("Create cache folder '%s'", path)
-		os.Mkdir(path, os.ModePerm)
+		sigolo.Error("Cannot open cache folder '%s': %s", cfg.Dir, err)
+		sigolo.Info("Create cache folder '%s'", cfg.Dir)
+		os.Mkdir(cfg.Dir, os.ModePerm)
 	}
 
 	values := make(map[string]KnownValues, 0)
@@ -44,27 +116,157 @@ func CreateCache(path string) (*Cache, error) {
 	// Go through every file an save its name in the map. The content of the file
 	// is loaded when needed. This makes sure that we don't have to read
 	// the directory content each time the user wants data that's not yet loaded.
+	// Sidecar meta files are skipped; they aren't cache entries themselves.
 	for _, info := range fileInfos {
-		if !info.IsDir() {
+		if !info.IsDir() && !strings.HasSuffix(info.Name(), metaSidecarSuffix) && !strings.Contains(info.Name(), cacheTmpInfix) {
 			values[info.Name()] = KnownValues{}
 		}
 	}
 
-	hash := sha256.New()
+	hitWindow := cfg.HitWindow
+	if hitWindow == 0 {
+		hitWindow = defaultHitWindow
+	}
+
+	maxOpenFiles := cfg.MaxOpenFiles
+	if maxOpenFiles == 0 {
+		maxOpenFiles = defaultMaxOpenFiles
+	}
 
-	mutex := &sync.Mutex{}
+	openFileIdleTTL := cfg.OpenFileIdleTTL
+	if openFileIdleTTL == 0 {
+		openFileIdleTTL = defaultOpenFileIdleTTL
+	}
 
 	cache := &Cache{
-		folder:      path,
-		hash:        hash,
-		knownValues: values,
-		busyValues:  busy,
-		mutex:       mutex,
+		name:            name,
+		folder:          cfg.Dir,
+		maxAge:          cfg.MaxAge,
+		maxSize:         cfg.MaxSize,
+		maxItems:        cfg.MaxItems,
+		hash:            sha256.New(),
+		knownValues:     values,
+		busyValues:      busy,
+		mutex:           &sync.Mutex{},
+		tidySignal:      make(chan struct{}, 1),
+		pendingHits:     make(map[string]hitCount, 0),
+		lastAccess:      make(map[string]time.Time, 0),
+		hitWindow:       hitWindow,
+		openFiles:       make(map[string]*openFileEnt),
+		openFilesOrder:  list.New(),
+		openFilesElems:  make(map[string]*list.Element),
+		maxOpenFiles:    maxOpenFiles,
+		openFileIdleTTL: openFileIdleTTL,
 	}
 
+	for _, info := range fileInfos {
+		if !info.IsDir() && !strings.HasSuffix(info.Name(), metaSidecarSuffix) && !strings.Contains(info.Name(), cacheTmpInfix) {
+			cache.currentSize += info.Size()
+		}
+	}
+
+	go cache.tidyLoop()
+	go cache.openFilesJanitorLoop()
+	go cache.hitsJanitorLoop()
+
 	return cache, nil
 }
 
+// selectCache picks the cache partition to use for cacheURL by matching it
+// against config.CacheRules, the same rules used for TTL lookup. A rule with
+// no Cache name, or no matching rule at all, routes to the "default" cache.
+func (cs Caches) selectCache(cacheURL string) (*Cache, CacheRule, error) {
+	for name, cr := range config.CacheRules {
+		r := regexp.MustCompile(cr.Regex)
+		if r.MatchString(cacheURL) {
+			cacheName := cr.Cache
+			if cacheName == "" {
+				cacheName = "default"
+			}
+			cache, ok := cs[cacheName]
+			if !ok {
+				return nil, cr, fmt.Errorf("rule '%s' references unknown cache '%s'", name, cacheName)
+			}
+			return cache, cr, nil
+		}
+	}
+
+	cache, ok := cs["default"]
+	if !ok {
+		return nil, CacheRule{}, fmt.Errorf("no cache rule matched '%s' and no 'default' cache is configured", cacheURL)
+	}
+	return cache, CacheRule{}, nil
+}
+
+// Get resolves requestedURL to a cache partition via config.CacheRules and
+// returns its cached content, fetching it if the partition's TTL has expired.
+func (cs Caches) Get(requestedURL string) (*io.Reader, error) {
+	cacheURL, err := removeSchemeFromURL(requestedURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, rule, err := cs.selectCache(cacheURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache.maxAge == 0 {
+		sigolo.Debug("Caching disabled for '%s', fetching directly", requestedURL)
+		return nil, fmt.Errorf("caching disabled for '%s'", cacheURL)
+	}
+
+	return cache.get(requestedURL, rule)
+}
+
+// Put resolves requestedURL to a cache partition and caches content together
+// with its integrity/revalidation metadata, unless the partition's rule
+// declares an After threshold that hasn't been reached yet for this key, or
+// the partition has caching disabled (MaxAge == 0), in which case content is
+// left unwritten.
+func (cs Caches) Put(requestedURL string, content *io.Reader, contentLength int64, meta CacheMeta) error {
+	cacheURL, err := removeSchemeFromURL(requestedURL)
+	if err != nil {
+		return err
+	}
+
+	cache, rule, err := cs.selectCache(cacheURL)
+	if err != nil {
+		return err
+	}
+
+	if cache.maxAge == 0 {
+		sigolo.Debug("Caching disabled for '%s', not writing to cache", requestedURL)
+		return fmt.Errorf("caching disabled for '%s'", cacheURL)
+	}
+
+	meta.URL = requestedURL
+
+	return cache.put(cacheURL, content, contentLength, rule, meta)
+}
+
+// Has resolves requestedURL to a cache partition and checks whether it
+// already holds the resource. See Cache.has for the busy-lock semantics.
+func (cs Caches) Has(requestedURL string) (*Cache, *sync.Mutex, bool, error) {
+	cacheURL, err := removeSchemeFromURL(requestedURL)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	cache, _, err := cs.selectCache(cacheURL)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if cache.maxAge == 0 {
+		sigolo.Debug("Caching disabled for '%s', fetching directly", requestedURL)
+		return nil, nil, false, fmt.Errorf("caching disabled for '%s'", cacheURL)
+	}
+
+	lock, found := cache.has(cacheURL)
+	return cache, lock, found, nil
+}
+
 // Returns true if the resource is found, and false otherwise. If the
 // resource is busy, this method will hang until the resource is free. If
 // the resource is not found, a lock indicating that the resource is busy will
@@ -100,7 +302,7 @@ func (c *Cache) has(key string) (*sync.Mutex, bool) {
 	return lock, false
 }
 
-func (c *Cache) get(requestedURL string) (*io.Reader, error) {
+func (c *Cache) get(requestedURL string, rule CacheRule) (*io.Reader, error) {
 	var response io.Reader
 	cacheURL, err := removeSchemeFromURL(requestedURL)
 	if err != nil {
@@ -118,59 +320,166 @@ func (c *Cache) get(requestedURL string) (*io.Reader, error) {
 		return nil, fmt.Errorf("Key '%s' is not known to cache", hashValue)
 	}
 
-	sigolo.Debug("requested URL '%s' has cache key '%s'", requestedURL, hashValue)
+	sigolo.Debug("requested URL '%s' has cache key '%s' in cache '%s'", requestedURL, hashValue, c.name)
 
 	// Key is known, but not loaded into RAM
 	if content == nil {
 		sigolo.Debug("Cache item '%s' known but is not stored in memory. Reading from file.", hashValue)
 
 		// check if Cache is too old based on mtime, if so call getRemote() and renew cache
-		err := checkCacheTTL(c.folder+hashValue, cacheURL, requestedURL)
+		err := c.checkCacheTTL(hashValue, cacheURL, requestedURL, rule)
 		if err != nil {
 			return nil, err
 		}
 
-		file, err := os.Open(c.folder + hashValue)
-		if err != nil {
-			sigolo.Error("Error reading cached file '%s': %s", hashValue, err)
-			return nil, err
+		if config.VerifyCacheIntegrity {
+			if err := c.verifyFileIntegrity(hashValue); err != nil {
+				return nil, err
+			}
 		}
 
-		fi, err := file.Stat()
+		reader, size, err := c.openHeldFile(hashValue)
 		if err != nil {
-			sigolo.Error("Error stating cached file '%s': %s", hashValue, err)
+			sigolo.Error("Error reading cached file '%s': %s", hashValue, err)
 			return nil, err
 		}
 
-		response = file
-		promSummaries["CACHE_READ_FILE"].Observe(float64(fi.Size()))
+		response = reader
+		promSummaries["CACHE_READ_FILE"].Observe(float64(size))
 
 	} else { // Key is known and data is already loaded to RAM
 		// check if Cache is too old based on mtime, if so call getRemote() and renew cache
-		err := checkCacheTTL(c.folder+hashValue, cacheURL, requestedURL)
+		err := c.checkCacheTTL(hashValue, cacheURL, requestedURL, rule)
 		if err != nil {
 			return nil, err
 		}
+
+		if config.VerifyCacheIntegrity {
+			if err := c.verifyContentIntegrity(hashValue, content); err != nil {
+				return nil, err
+			}
+		}
+
 		response = bytes.NewReader(content)
 		promSummaries["CACHE_READ_MEMORY"].Observe(float64(len(content)))
 	}
 
+	c.touchAccess(hashValue)
+
 	return &response, nil
 }
 
+// touchAccess records that hashValue was just read, so tidy evicts by
+// least-recently-used rather than least-recently-written.
+func (c *Cache) touchAccess(hashValue string) {
+	c.mutex.Lock()
+	c.lastAccess[hashValue] = time.Now()
+	c.mutex.Unlock()
+}
+
 // release is an internal method which atomically caches an item and unmarks
 // the item as busy, if it was busy before. The busy lock *must* be unlocked
 // elsewhere!
-func (c *Cache) release(hashValue string, content []byte, loadedAt time.Time) {
+func (c *Cache) release(hashValue string, content []byte, loadedAt time.Time, size int64) {
 	c.mutex.Lock()
 	delete(c.busyValues, hashValue)
-	c.knownValues[hashValue] = KnownValues{content: content, loadedAt: loadedAt}
+	delete(c.pendingHits, hashValue)
+	previousSize := c.knownValues[hashValue].size
+	c.knownValues[hashValue] = KnownValues{content: content, loadedAt: loadedAt, size: size}
+	c.lastAccess[hashValue] = loadedAt
 	c.mutex.Unlock()
+
+	// A refresh of an already-known key (plain TTL expiry or chunk0-5's
+	// stale-while-revalidate) re-adds this entry's size on top of the one
+	// already counted the first time it was released; subtract the old size
+	// first so currentSize tracks what's actually on disk instead of
+	// drifting upward with every refresh.
+	atomic.AddInt64(&c.currentSize, size-previousSize)
+	c.wakeTidyIfOverQuota()
+
+	// The file on disk was just (re)written; any held-open handle from
+	// before this refresh would now serve stale bytes.
+	c.invalidateHeldFile(hashValue)
+}
+
+// skip unmarks hashValue as busy without caching it, used when a rule's
+// After threshold hasn't been reached yet for this key.
+func (c *Cache) skip(hashValue string) {
+	c.mutex.Lock()
+	delete(c.busyValues, hashValue)
+	c.mutex.Unlock()
+}
+
+// countHit records a request for hashValue and returns the number of hits
+// seen for it within hitWindow. A gap longer than hitWindow resets the count
+// to 1, so a key that cools off has to earn its way back to being cached.
+func (c *Cache) countHit(hashValue string) int {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	hc, ok := c.pendingHits[hashValue]
+	if !ok || now.Sub(hc.seenAt) > c.hitWindow {
+		hc = hitCount{}
+	}
+	hc.count++
+	hc.seenAt = now
+	c.pendingHits[hashValue] = hc
+
+	return hc.count
+}
+
+// hitsJanitorInterval is how often hitsJanitorLoop sweeps pendingHits for
+// counts that aged out without ever reaching their rule's After threshold.
+const hitsJanitorInterval = 1 * time.Minute
+
+// hitsJanitorLoop periodically drops pendingHits entries that haven't been
+// hit again within hitWindow, so a key that never reaches its After
+// threshold doesn't sit in the map forever.
+func (c *Cache) hitsJanitorLoop() {
+	ticker := time.NewTicker(hitsJanitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		c.mutex.Lock()
+		for hashValue, hc := range c.pendingHits {
+			if now.Sub(hc.seenAt) > c.hitWindow {
+				delete(c.pendingHits, hashValue)
+			}
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// wakeTidyIfOverQuota pokes tidyLoop once currentSize has crossed maxSize,
+// instead of leaving a cache over quota until the next periodic tick.
+func (c *Cache) wakeTidyIfOverQuota() {
+	if c.maxSize <= 0 || atomic.LoadInt64(&c.currentSize) <= c.maxSize {
+		return
+	}
+	select {
+	case c.tidySignal <- struct{}{}:
+	default:
+		// a tidy run is already pending/in progress
+	}
 }
 
-func (c *Cache) put(key string, content *io.Reader, contentLength int64) error {
+func (c *Cache) put(key string, content *io.Reader, contentLength int64, rule CacheRule, meta CacheMeta) error {
 	hashValue := calcHash(key)
 
+	if rule.After > 0 {
+		hits := c.countHit(hashValue)
+		if hits < rule.After {
+			sigolo.Debug("Key '%s' has %d/%d hits, streaming through without caching", hashValue, hits, rule.After)
+			c.skip(hashValue)
+			return nil
+		}
+	}
+
+	meta.LoadedAt = time.Now()
+
 	// Small enough to put it into the in-memory cache
 	if contentLength <= config.MaxCacheItemSize*1024*1024 {
 		buffer := &bytes.Buffer{}
@@ -179,77 +488,192 @@ func (c *Cache) put(key string, content *io.Reader, contentLength int64) error {
 			return err
 		}
 
-		defer c.release(hashValue, buffer.Bytes(), time.Now())
-		sigolo.Debug("Added %s into in-memory cache", hashValue)
+		meta.SHA256 = calcSHA256(buffer.Bytes())
+		defer c.release(hashValue, buffer.Bytes(), meta.LoadedAt, int64(buffer.Len()))
+		sigolo.Debug("Added %s into in-memory cache '%s'", hashValue, c.name)
 
-		err = ioutil.WriteFile(c.folder+hashValue, buffer.Bytes(), 0644)
-		if err != nil {
+		if err := c.writeEntryFile(hashValue, func(w io.Writer) error {
+			_, err := w.Write(buffer.Bytes())
+			return err
+		}); err != nil {
 			return err
 		}
 		sigolo.Debug("Wrote content of entry %s into file", hashValue)
 	} else { // Too large for in-memory cache, just write to file
-		defer c.release(hashValue, nil, time.Now())
-		sigolo.Debug("Added nil-entry for %s into in-memory cache", hashValue)
+		defer c.release(hashValue, nil, meta.LoadedAt, contentLength)
+		sigolo.Debug("Added nil-entry for %s into in-memory cache '%s'", hashValue, c.name)
 
-		file, err := os.Create(c.folder + hashValue)
-		if err != nil {
+		hasher := sha256.New()
+		if err := c.writeEntryFile(hashValue, func(w io.Writer) error {
+			_, err := io.Copy(w, io.TeeReader(*content, hasher))
 			return err
-		}
-
-		writer := bufio.NewWriter(file)
-		_, err = io.Copy(writer, *content)
-		if err != nil {
+		}); err != nil {
 			return err
 		}
+		meta.SHA256 = hex.EncodeToString(hasher.Sum(nil))
 		sigolo.Debug("Wrote content of entry %s into file", hashValue)
 	}
 
+	if err := writeMetaSidecar(c.folder+hashValue, meta); err != nil {
+		sigolo.Error("Error writing meta sidecar for '%s': %s", hashValue, err)
+	}
+
 	sigolo.Debug("Cache wrote content into '%s'", hashValue)
 
 	return nil
 }
 
+// writeEntryFile writes a cache entry's content via write, then atomically
+// publishes it as c.folder+hashValue. It writes to a uniquely-named temp file
+// in the same folder first and renames it into place, rather than writing
+// the final path directly, so a reader holding an already-open handle onto
+// the previous version of this entry (see openfiles.go) keeps reading the
+// old, complete inode instead of racing a concurrent truncate/rewrite; new
+// opens only ever see either the old or the fully-written new file.
+func (c *Cache) writeEntryFile(hashValue string, write func(io.Writer) error) error {
+	tmpFile, err := ioutil.TempFile(c.folder, hashValue+cacheTmpInfix+"*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	writer := bufio.NewWriter(tmpFile)
+	writeErr := write(writer)
+	if writeErr == nil {
+		writeErr = writer.Flush()
+	}
+	closeErr := tmpFile.Close()
+
+	if writeErr != nil {
+		os.Remove(tmpPath)
+		return writeErr
+	}
+	if closeErr != nil {
+		os.Remove(tmpPath)
+		return closeErr
+	}
+
+	if err := os.Rename(tmpPath, c.folder+hashValue); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
 func calcHash(data string) string {
 	sha := sha256.Sum256([]byte(data))
 	return hex.EncodeToString(sha[:])
 }
 
-func checkCacheTTL(filePath string, cacheURL string, requestedURL string) error {
+// checkCacheTTL is called before serving a cached entry. A fresh entry is
+// served as-is. A stale one within rule.StaleWhileRevalidate is still served,
+// with a background refresh kicked off so the next request finds it fresh.
+// Only an entry stale beyond that window blocks the caller on a foreground
+// GetRemote.
+func (c *Cache) checkCacheTTL(hashValue string, cacheURL string, requestedURL string, rule CacheRule) error {
+	filePath := c.folder + hashValue
+
 	fi, err := os.Stat(filePath)
 	if err != nil {
 		return err
 	}
 	mtime := fi.ModTime()
 
-	ttl := config.DefaultCacheTTL
-	for name, cr := range config.CacheRules {
-		r := regexp.MustCompile(cr.Regex)
-		// sigolo.Debug("comparing regex rule: '%s' with regex '%s' with cacheURL: '%s'", name, cr.Regex, cacheURL)
-		if r.MatchString(cacheURL) {
-			sigolo.Debug("found matching regex rule: '%s' with regex '%s' and ttl '%s' for cacheURL: '%s'", name, cr.Regex, cr.TTL, cacheURL)
-			ttl = cr.TTL
-			// sigolo.Debug("setting ttl to '%s' for file '%s'", ttl, cacheURL)
-			break
-		}
+	// The partition's own MaxAge is the default freshness window; a matching
+	// rule's non-zero TTL overrides it. config.DefaultCacheTTL is used only
+	// when maxAge is 0, a partition that Get already rejects as disabled.
+	ttl := c.maxAge
+	if ttl == 0 {
+		ttl = config.DefaultCacheTTL
+	}
+	if rule.Regex != "" && rule.TTL != 0 {
+		ttl = rule.TTL
+	}
+
+	if ttl < 0 {
+		sigolo.Info("CACHE_OK, '%s' never expires for requested URL '%s'", c.name, cacheURL)
+		promCounters["CACHE_OK"].Inc()
+		return nil
 	}
 
 	sigolo.Debug("using cache TTL '%s' for file: '%s'", ttl, cacheURL)
 	validUntil := mtime.Add(ttl)
 
-	//valid := time.Now().AddDate(1, 0, 0)
-	//fmt.Println(validUntil)
-	// sigolo.Info("cacheURL:", cacheURL)
-	// sigolo.Info("requestedURL:", requestedURL)
-	if time.Now().After(validUntil) {
-		sigolo.Info("CACHE_TOO_OLD for requested URL '%s'", cacheURL)
-		promCounters["CACHE_TOO_OLD"].Inc()
-		err := GetRemote(requestedURL)
-		if err != nil {
-			return err
-		}
+	now := time.Now()
+	if !now.After(validUntil) {
+		sigolo.Info("CACHE_OK until '%s'/'%s' for requested URL '%s'", time.Until(validUntil), validUntil.Format("2006-01-02 15:04:05"), cacheURL)
+		promCounters["CACHE_OK"].Inc()
 		return nil
 	}
-	sigolo.Info("CACHE_OK until '%s'/'%s' for requested URL '%s'", time.Until(validUntil), validUntil.Format("2006-01-02 15:04:05"), cacheURL)
-	promCounters["CACHE_OK"].Inc()
-	return nil
+
+	staleUntil := validUntil.Add(rule.StaleWhileRevalidate)
+	if rule.StaleWhileRevalidate > 0 && now.Before(staleUntil) {
+		sigolo.Info("CACHE_STALE, serving stale content and refreshing '%s' in background", cacheURL)
+		promCounters["CACHE_STALE"].Inc()
+		c.refreshStaleAsync(hashValue, requestedURL)
+		return nil
+	}
+
+	sigolo.Info("CACHE_TOO_OLD for requested URL '%s'", cacheURL)
+	promCounters["CACHE_TOO_OLD"].Inc()
+	return c.refreshTooOld(hashValue, requestedURL, filePath)
+}
+
+// refreshTooOld refreshes a too-old entry in the foreground, joining the same
+// busyValues protocol as has()/refreshStaleAsync so a burst of requests for
+// the same expired key triggers a single upstream fetch instead of one per
+// request; the rest simply wait for it to finish and then see the refreshed
+// file.
+func (c *Cache) refreshTooOld(hashValue string, requestedURL string, filePath string) error {
+	c.mutex.Lock()
+	if lock, busy := c.busyValues[hashValue]; busy {
+		c.mutex.Unlock()
+		sigolo.Debug("Refresh for '%s' already in progress, waiting for it", hashValue)
+		lock.Lock()
+		lock.Unlock()
+		return nil
+	}
+	lock := new(sync.Mutex)
+	lock.Lock()
+	c.busyValues[hashValue] = lock
+	c.mutex.Unlock()
+
+	err := GetRemote(requestedURL, readMetaSidecar(filePath))
+
+	c.mutex.Lock()
+	delete(c.busyValues, hashValue)
+	c.mutex.Unlock()
+	lock.Unlock()
+
+	return err
+}
+
+// refreshStaleAsync kicks off a background refresh of hashValue, deduplicated
+// through busyValues so a burst of requests for the same stale key only
+// triggers one upstream fetch. A foreground request racing the same key
+// simply waits on the busy lock like any other cache miss.
+func (c *Cache) refreshStaleAsync(hashValue string, requestedURL string) {
+	c.mutex.Lock()
+	if _, busy := c.busyValues[hashValue]; busy {
+		c.mutex.Unlock()
+		sigolo.Debug("Stale refresh for '%s' already in progress, skipping", hashValue)
+		return
+	}
+	lock := new(sync.Mutex)
+	lock.Lock()
+	c.busyValues[hashValue] = lock
+	c.mutex.Unlock()
+
+	go func() {
+		defer lock.Unlock()
+
+		if err := GetRemote(requestedURL, readMetaSidecar(c.folder+hashValue)); err != nil {
+			sigolo.Error("Error refreshing stale cache entry '%s': %s", hashValue, err)
+		}
+
+		c.mutex.Lock()
+		delete(c.busyValues, hashValue)
+		c.mutex.Unlock()
+	}()
 }
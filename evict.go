@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hauke96/sigolo"
+)
+
+// tidyInterval is how often a cache is tidied even if it never crossed its
+// high-water mark, e.g. to pick up files that appeared on disk externally.
+const tidyInterval = 5 * time.Minute
+
+// tidyLowWaterMark is the fraction of maxSize a tidy run evicts down to, so a
+// cache sitting right at quota doesn't trigger another eviction on the very
+// next write.
+const tidyLowWaterMark = 0.9
+
+// tidyLoop runs for the lifetime of the process, evicting entries from c
+// whenever it is woken by tidySignal or the periodic ticker fires. Caches
+// with neither a size quota nor an item-count quota (maxSize <= 0 and
+// maxItems <= 0) never tidy.
+func (c *Cache) tidyLoop() {
+	if c.maxSize <= 0 && c.maxItems <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tidyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.tidySignal:
+		}
+
+		if err := c.tidy(); err != nil {
+			sigolo.Error("Error tidying cache '%s': %s", c.name, err)
+		}
+	}
+}
+
+type cacheEntry struct {
+	hash       string
+	size       int64
+	lastAccess time.Time
+}
+
+// tidy walks c.folder and deletes the least-recently-used entries until
+// usage drops to tidyLowWaterMark of maxSize and the item count drops to
+// maxItems. It keeps knownValues and currentSize in sync with what actually
+// remains on disk. A quota <= 0 means that quota isn't enforced.
+func (c *Cache) tidy() error {
+	fileInfos, err := ioutil.ReadDir(c.folder)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	entries := make([]cacheEntry, 0, len(fileInfos))
+	var total int64
+	for _, fi := range fileInfos {
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), metaSidecarSuffix) || strings.Contains(fi.Name(), cacheTmpInfix) {
+			continue
+		}
+		lastAccess, ok := c.lastAccess[fi.Name()]
+		if !ok {
+			lastAccess = fi.ModTime()
+		}
+		entries = append(entries, cacheEntry{hash: fi.Name(), size: fi.Size(), lastAccess: lastAccess})
+		total += fi.Size()
+	}
+	c.mutex.Unlock()
+
+	overSize := c.maxSize > 0 && total > c.maxSize
+	overItems := c.maxItems > 0 && len(entries) > c.maxItems
+	if !overSize && !overItems {
+		atomic.StoreInt64(&c.currentSize, total)
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	lowWaterMark := int64(0)
+	if c.maxSize > 0 {
+		lowWaterMark = int64(float64(c.maxSize) * tidyLowWaterMark)
+	}
+	sigolo.Info("Cache '%s' at %d bytes/%d items, quota %d bytes/%d items, evicting down to %d bytes/%d items", c.name, total, len(entries), c.maxSize, c.maxItems, lowWaterMark, c.maxItems)
+
+	remaining := len(entries)
+	for _, entry := range entries {
+		overSize := c.maxSize > 0 && total > lowWaterMark
+		overItems := c.maxItems > 0 && remaining > c.maxItems
+		if !overSize && !overItems {
+			break
+		}
+
+		if err := os.Remove(c.folder + entry.hash); err != nil {
+			sigolo.Error("Error evicting cache entry '%s' from '%s': %s", entry.hash, c.name, err)
+			continue
+		}
+		os.Remove(c.folder + entry.hash + metaSidecarSuffix)
+
+		c.mutex.Lock()
+		delete(c.knownValues, entry.hash)
+		delete(c.lastAccess, entry.hash)
+		c.mutex.Unlock()
+		c.invalidateHeldFile(entry.hash)
+
+		total -= entry.size
+		remaining--
+		promCounters["CACHE_EVICTED"].Inc()
+	}
+
+	atomic.StoreInt64(&c.currentSize, total)
+
+	return nil
+}
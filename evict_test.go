@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCache builds a *Cache with just enough wiring for tidy()/release()
+// to run against folder, bypassing createCache so these tests don't depend
+// on CacheConfig/Config, which live outside this package's test scope.
+func newTestCache(folder string, maxSize int64, maxItems int) *Cache {
+	return &Cache{
+		name:           "test",
+		folder:         folder,
+		maxSize:        maxSize,
+		maxItems:       maxItems,
+		knownValues:    make(map[string]KnownValues),
+		busyValues:     make(map[string]*sync.Mutex),
+		mutex:          &sync.Mutex{},
+		tidySignal:     make(chan struct{}, 1),
+		pendingHits:    make(map[string]hitCount),
+		lastAccess:     make(map[string]time.Time),
+		openFiles:      make(map[string]*openFileEnt),
+		openFilesOrder: list.New(),
+		openFilesElems: make(map[string]*list.Element),
+	}
+}
+
+func writeTestEntry(t *testing.T, folder, hash string, size int, age time.Duration) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(filepath.Join(folder, hash), make([]byte, size), 0644); err != nil {
+		t.Fatalf("writing test entry '%s': %s", hash, err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(folder, hash), modTime, modTime); err != nil {
+		t.Fatalf("setting mtime on test entry '%s': %s", hash, err)
+	}
+}
+
+func TestTidy_EvictsBySizeQuota(t *testing.T) {
+	folder := t.TempDir() + string(os.PathSeparator)
+
+	writeTestEntry(t, folder, "oldest", 100, 3*time.Minute)
+	writeTestEntry(t, folder, "middle", 100, 2*time.Minute)
+	writeTestEntry(t, folder, "newest", 100, 1*time.Minute)
+
+	c := newTestCache(folder, 250, 0)
+
+	if err := c.tidy(); err != nil {
+		t.Fatalf("tidy() returned error: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(folder, "oldest")); !os.IsNotExist(err) {
+		t.Errorf("expected 'oldest' entry to be evicted, but it still exists")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "middle")); err != nil {
+		t.Errorf("expected 'middle' entry to survive, got: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "newest")); err != nil {
+		t.Errorf("expected 'newest' entry to survive, got: %s", err)
+	}
+}
+
+func TestTidy_EvictsByItemQuota(t *testing.T) {
+	folder := t.TempDir() + string(os.PathSeparator)
+
+	writeTestEntry(t, folder, "oldest", 10, 3*time.Minute)
+	writeTestEntry(t, folder, "middle", 10, 2*time.Minute)
+	writeTestEntry(t, folder, "newest", 10, 1*time.Minute)
+
+	c := newTestCache(folder, 0, 2)
+
+	if err := c.tidy(); err != nil {
+		t.Fatalf("tidy() returned error: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(folder, "oldest")); !os.IsNotExist(err) {
+		t.Errorf("expected 'oldest' entry to be evicted, but it still exists")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "middle")); err != nil {
+		t.Errorf("expected 'middle' entry to survive, got: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "newest")); err != nil {
+		t.Errorf("expected 'newest' entry to survive, got: %s", err)
+	}
+}
+
+func TestTidy_UsesLastAccessOverModTime(t *testing.T) {
+	folder := t.TempDir() + string(os.PathSeparator)
+
+	// "a" is written after "b" on disk (newer mtime), but "b" was read more
+	// recently, so tidy must evict "a" first.
+	writeTestEntry(t, folder, "a", 100, 2*time.Minute)
+	writeTestEntry(t, folder, "b", 100, 3*time.Minute)
+
+	c := newTestCache(folder, 150, 0)
+	c.lastAccess["b"] = time.Now()
+
+	if err := c.tidy(); err != nil {
+		t.Fatalf("tidy() returned error: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(folder, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected 'a' entry to be evicted based on lastAccess, but it still exists")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "b")); err != nil {
+		t.Errorf("expected 'b' entry to survive, got: %s", err)
+	}
+}
+
+func TestTidy_SkipsMetaSidecarsAndTempFiles(t *testing.T) {
+	folder := t.TempDir() + string(os.PathSeparator)
+
+	writeTestEntry(t, folder, "entry", 10, time.Minute)
+	// Named after an unrelated hash so evicting "entry" can't coincidentally
+	// remove these via its own hash+metaSidecarSuffix cleanup.
+	writeTestEntry(t, folder, "survivor"+metaSidecarSuffix, 10, time.Minute)
+	writeTestEntry(t, folder, "survivor"+cacheTmpInfix+"123", 10, time.Minute)
+
+	// A quota so low it would evict everything it considers a real entry,
+	// to prove the sidecar/temp files were never counted as entries.
+	c := newTestCache(folder, 1, 0)
+
+	if err := c.tidy(); err != nil {
+		t.Fatalf("tidy() returned error: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(folder, "survivor"+metaSidecarSuffix)); err != nil {
+		t.Errorf("expected meta sidecar to survive untouched, got: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "survivor"+cacheTmpInfix+"123")); err != nil {
+		t.Errorf("expected temp file to survive untouched, got: %s", err)
+	}
+}
+
+func TestCacheRelease_DoesNotDoubleCountSizeOnRefresh(t *testing.T) {
+	c := newTestCache(t.TempDir()+string(os.PathSeparator), 0, 0)
+
+	c.release("key", []byte("0123456789"), time.Now(), 10)
+	if got := c.currentSize; got != 10 {
+		t.Fatalf("currentSize after first release = %d, want 10", got)
+	}
+
+	// A refresh of the same key must replace, not add to, the previously
+	// counted size.
+	c.release("key", []byte("01234"), time.Now(), 5)
+	if got := c.currentSize; got != 5 {
+		t.Fatalf("currentSize after refreshing release = %d, want 5 (was double-counted)", got)
+	}
+}
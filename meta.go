@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/hauke96/sigolo"
+)
+
+// metaSidecarSuffix is appended to a cache entry's hash to name its sidecar
+// metadata file.
+const metaSidecarSuffix = ".meta.json"
+
+// CacheMeta is the sidecar written alongside every cached blob. It turns the
+// cache from an opaque byte store into a proper HTTP cache: SHA256 lets get
+// detect a half-written or corrupted file, and ETag/LastModified let a
+// revalidation be a conditional request instead of a full re-download.
+type CacheMeta struct {
+	SHA256       string    `json:"sha256"`
+	URL          string    `json:"url"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	LoadedAt     time.Time `json:"loaded_at"`
+}
+
+func writeMetaSidecar(path string, meta CacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+metaSidecarSuffix, data, 0644)
+}
+
+// readMetaSidecar loads the sidecar for path, returning nil if it is
+// missing or unreadable rather than an error, since a missing sidecar just
+// means the entry predates this feature and has nothing to verify against.
+func readMetaSidecar(path string) *CacheMeta {
+	data, err := ioutil.ReadFile(path + metaSidecarSuffix)
+	if err != nil {
+		return nil
+	}
+
+	var meta CacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		sigolo.Error("Error parsing meta sidecar '%s%s': %s", path, metaSidecarSuffix, err)
+		return nil
+	}
+
+	return &meta
+}
+
+func calcSHA256(data []byte) string {
+	sha := sha256.Sum256(data)
+	return hex.EncodeToString(sha[:])
+}
+
+// verifyContentIntegrity checks an in-memory cache entry's bytes against its
+// sidecar's recorded SHA256, evicting the entry if they no longer match.
+func (c *Cache) verifyContentIntegrity(hashValue string, content []byte) error {
+	meta := readMetaSidecar(c.folder + hashValue)
+	if meta == nil || meta.SHA256 == "" {
+		return nil
+	}
+
+	if calcSHA256(content) != meta.SHA256 {
+		c.evictCorrupt(hashValue)
+		return fmt.Errorf("cache entry '%s' failed integrity check, evicted", hashValue)
+	}
+
+	return nil
+}
+
+// verifyFileIntegrity checks an on-disk cache entry against its sidecar's
+// recorded SHA256, evicting the entry if they no longer match. This reads
+// the whole file to hash it, so it's only worth the cost when
+// config.VerifyCacheIntegrity opts into the extra safety.
+func (c *Cache) verifyFileIntegrity(hashValue string) error {
+	meta := readMetaSidecar(c.folder + hashValue)
+	if meta == nil || meta.SHA256 == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(c.folder + hashValue)
+	if err != nil {
+		return err
+	}
+
+	if calcSHA256(content) != meta.SHA256 {
+		c.evictCorrupt(hashValue)
+		return fmt.Errorf("cache entry '%s' failed integrity check, evicted", hashValue)
+	}
+
+	return nil
+}
+
+// evictCorrupt removes a cache entry and its sidecar from disk and from
+// knownValues/openFiles, used when verifyContentIntegrity/verifyFileIntegrity
+// detect a mismatch.
+func (c *Cache) evictCorrupt(hashValue string) {
+	sigolo.Error("Cache entry '%s' in cache '%s' failed integrity check, evicting", hashValue, c.name)
+	promCounters["CACHE_CORRUPT"].Inc()
+
+	c.mutex.Lock()
+	known, ok := c.knownValues[hashValue]
+	delete(c.knownValues, hashValue)
+	delete(c.lastAccess, hashValue)
+	c.mutex.Unlock()
+
+	if err := os.Remove(c.folder + hashValue); err != nil {
+		sigolo.Error("Error removing corrupt cache entry '%s': %s", hashValue, err)
+	}
+	if err := os.Remove(c.folder + hashValue + metaSidecarSuffix); err != nil {
+		sigolo.Error("Error removing meta sidecar for corrupt cache entry '%s': %s", hashValue, err)
+	}
+	c.invalidateHeldFile(hashValue)
+
+	if ok {
+		atomic.AddInt64(&c.currentSize, -known.size)
+	}
+}
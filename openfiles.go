@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/hauke96/sigolo"
+)
+
+// defaultMaxOpenFiles bounds how many file handles a cache keeps held open
+// for hot reads when a cache's config doesn't set MaxOpenFiles.
+const defaultMaxOpenFiles = 128
+
+// defaultOpenFileIdleTTL is used when a cache's config doesn't set
+// OpenFileIdleTTL.
+const defaultOpenFileIdleTTL = 2 * time.Minute
+
+// openFilesJanitorInterval is how often openFilesJanitorLoop sweeps for
+// handles that have sat idle longer than openFileIdleTTL.
+const openFilesJanitorInterval = 1 * time.Minute
+
+// openFileEnt is a held-open *os.File shared by concurrent readers of the
+// same cache entry. refs tracks readers that still hold a sectionReader
+// backed by file; it is only closed once refs drops to zero.
+type openFileEnt struct {
+	hashValue string
+	file      *os.File
+	size      int64
+	lastUsed  time.Time
+	refs      int
+	closing   bool
+}
+
+// sectionReader is the io.Reader/io.Closer handed back to callers of
+// Cache.get for on-disk entries. Its ReadAt is backed directly by the
+// shared, held-open *os.File, so concurrent readers don't need to coordinate
+// seeks; Close only releases this reader's own reference to ent, which keeps
+// working correctly even if ent has since been evicted from c.openFiles and
+// replaced by a newer entry for the same hash.
+type sectionReader struct {
+	*io.SectionReader
+	cache *Cache
+	ent   *openFileEnt
+}
+
+func (r *sectionReader) Close() error {
+	r.cache.releaseHeldFile(r.ent)
+	return nil
+}
+
+// openHeldFile returns a reader over the cached file for hashValue, reusing
+// an already-open handle when one exists instead of calling os.Open again.
+func (c *Cache) openHeldFile(hashValue string) (*sectionReader, int64, error) {
+	c.openFilesMutex.Lock()
+	if ent, ok := c.openFiles[hashValue]; ok && !ent.closing {
+		ent.refs++
+		ent.lastUsed = time.Now()
+		c.touchOpenFileLocked(hashValue)
+		c.openFilesMutex.Unlock()
+		return &sectionReader{io.NewSectionReader(ent.file, 0, ent.size), c, ent}, ent.size, nil
+	}
+	c.openFilesMutex.Unlock()
+
+	file, err := os.Open(c.folder + hashValue)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	ent := &openFileEnt{hashValue: hashValue, file: file, size: fi.Size(), lastUsed: time.Now(), refs: 1}
+
+	c.openFilesMutex.Lock()
+	c.openFiles[hashValue] = ent
+	c.touchOpenFileLocked(hashValue)
+	c.evictOpenFilesLocked()
+	c.openFilesMutex.Unlock()
+
+	return &sectionReader{io.NewSectionReader(ent.file, 0, ent.size), c, ent}, ent.size, nil
+}
+
+// touchOpenFileLocked moves hashValue to the front of the LRU order.
+// c.openFilesMutex must be held.
+func (c *Cache) touchOpenFileLocked(hashValue string) {
+	if elem, ok := c.openFilesElems[hashValue]; ok {
+		c.openFilesOrder.MoveToFront(elem)
+		return
+	}
+	c.openFilesElems[hashValue] = c.openFilesOrder.PushFront(hashValue)
+}
+
+// evictOpenFilesLocked closes the least-recently-used handles until the pool
+// is back within maxOpenFiles. A handle still in use (refs > 0) is marked
+// closing instead, and closed by releaseHeldFile once its last reader is done.
+// c.openFilesMutex must be held.
+func (c *Cache) evictOpenFilesLocked() {
+	for len(c.openFiles) > c.maxOpenFiles {
+		oldest := c.openFilesOrder.Back()
+		if oldest == nil {
+			return
+		}
+		hashValue := oldest.Value.(string)
+		c.closeOpenFileLocked(hashValue)
+	}
+}
+
+// closeOpenFileLocked removes hashValue's entry from the LRU bookkeeping and
+// closes its file, unless it's still being read, in which case it's closed
+// by releaseHeldFile once the last reader finishes. c.openFilesMutex must be
+// held.
+func (c *Cache) closeOpenFileLocked(hashValue string) {
+	ent, ok := c.openFiles[hashValue]
+	if !ok {
+		return
+	}
+
+	if elem, ok := c.openFilesElems[hashValue]; ok {
+		c.openFilesOrder.Remove(elem)
+		delete(c.openFilesElems, hashValue)
+	}
+	delete(c.openFiles, hashValue)
+
+	if ent.refs > 0 {
+		ent.closing = true
+		return
+	}
+
+	if err := ent.file.Close(); err != nil {
+		sigolo.Error("Error closing held-open cache file '%s': %s", hashValue, err)
+	}
+}
+
+// releaseHeldFile decrements ent's reference count and closes its handle if
+// it was marked closing and this was the last reader. It operates on ent
+// directly rather than looking it up in c.openFiles by hash, since by the
+// time a reader closes, that map slot may already hold a newer entry for
+// the same hash (evicted-and-reopened in between).
+func (c *Cache) releaseHeldFile(ent *openFileEnt) {
+	c.openFilesMutex.Lock()
+	defer c.openFilesMutex.Unlock()
+
+	ent.refs--
+	if ent.refs <= 0 && ent.closing {
+		if err := ent.file.Close(); err != nil {
+			sigolo.Error("Error closing held-open cache file '%s': %s", ent.hashValue, err)
+		}
+	}
+}
+
+// invalidateHeldFile forces hashValue's handle closed, used when its content
+// is evicted or overwritten so stale data is never reused.
+func (c *Cache) invalidateHeldFile(hashValue string) {
+	c.openFilesMutex.Lock()
+	defer c.openFilesMutex.Unlock()
+	c.closeOpenFileLocked(hashValue)
+}
+
+// openFilesJanitorLoop periodically closes handles that have sat idle longer
+// than openFileIdleTTL, freeing FDs a bursty hot-spot no longer needs.
+func (c *Cache) openFilesJanitorLoop() {
+	ticker := time.NewTicker(openFilesJanitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.openFilesMutex.Lock()
+		now := time.Now()
+		for hashValue, ent := range c.openFiles {
+			if ent.refs == 0 && !ent.closing && now.Sub(ent.lastUsed) > c.openFileIdleTTL {
+				c.closeOpenFileLocked(hashValue)
+			}
+		}
+		c.openFilesMutex.Unlock()
+	}
+}